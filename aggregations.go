@@ -0,0 +1,277 @@
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"io"
+	"log"
+	"net/http"
+	"strings"
+)
+
+// AggResponse is the parts of an Elasticsearch aggregation response we need: just the
+// aggregations tree, keyed by aggregation name.
+type AggResponse struct {
+	Aggregations map[string]json.RawMessage `json:"aggregations"`
+}
+
+// CompositeBucket is a single bucket of a composite aggregation, with its source key/value
+// pairs, doc_count, and any configured sub-aggregation results.
+type CompositeBucket struct {
+	Key      map[string]interface{}
+	DocCount int
+	Metrics  map[string]interface{}
+}
+
+// runAggregationExport sends rawQuery with size:0, walks the composite aggregation in the
+// response, and writes one CSV row per bucket: the composite source keys, doc_count, and any
+// metrics configured via metricPaths. It follows after_key pagination until the aggregation is
+// exhausted.
+func runAggregationExport(client *ESClient, index, rawQuery string, metricPaths []string, encoder Encoder) error {
+	body, err := aggregationRequestBody(rawQuery)
+	if err != nil {
+		return err
+	}
+
+	aggName, aggDef, err := findCompositeAgg(body)
+	if err != nil {
+		return err
+	}
+
+	header := aggregationHeader(aggDef, metricPaths)
+
+	if err := encoder.WriteHeader(header); err != nil {
+		return err
+	}
+
+	var hitCount int
+
+	for {
+		data, err := json.Marshal(body)
+		if err != nil {
+			return err
+		}
+
+		searchURL := fmt.Sprintf("%s/_search", client.BaseURL)
+		if index != "" {
+			searchURL = fmt.Sprintf("%s/%s/_search", client.BaseURL, index)
+		}
+
+		req, err := http.NewRequest("POST", searchURL, strings.NewReader(string(data)))
+		if err != nil {
+			return err
+		}
+
+		resp, err := sendAggRequest(client, req)
+		if err != nil {
+			return err
+		}
+
+		raw, ok := resp.Aggregations[aggName]
+		if !ok {
+			return fmt.Errorf("aggregation %q missing from response", aggName)
+		}
+
+		var composite struct {
+			AfterKey map[string]interface{}   `json:"after_key"`
+			Buckets  []map[string]interface{} `json:"buckets"`
+		}
+
+		if err := json.Unmarshal(raw, &composite); err != nil {
+			return err
+		}
+
+		for _, rawBucket := range composite.Buckets {
+			bucket := parseCompositeBucket(rawBucket)
+
+			if err := encoder.WriteRow(header, ResultHit{Source: bucketRow(bucket, metricPaths)}); err != nil {
+				return err
+			}
+		}
+
+		hitCount += len(composite.Buckets)
+
+		log.Printf("got %d buckets", hitCount)
+
+		if len(composite.Buckets) == 0 || composite.AfterKey == nil {
+			return nil
+		}
+
+		aggDef["composite"].(map[string]interface{})["after"] = composite.AfterKey
+	}
+}
+
+// aggregationRequestBody parses rawQuery and forces size:0, since we only want aggregations
+// back, not matching hits.
+func aggregationRequestBody(rawQuery string) (map[string]interface{}, error) {
+	body := map[string]interface{}{}
+
+	if rawQuery != "" {
+		if err := json.Unmarshal([]byte(rawQuery), &body); err != nil {
+			return nil, err
+		}
+	}
+
+	body["size"] = 0
+
+	return body, nil
+}
+
+// findCompositeAgg returns the name and definition of the first top-level aggregation in body
+// that's a composite aggregation.
+func findCompositeAgg(body map[string]interface{}) (string, map[string]interface{}, error) {
+	aggs, _ := body["aggs"].(map[string]interface{})
+	if aggs == nil {
+		aggs, _ = body["aggregations"].(map[string]interface{})
+	}
+
+	for name, def := range aggs {
+		defMap, ok := def.(map[string]interface{})
+		if !ok {
+			continue
+		}
+
+		if _, ok := defMap["composite"]; ok {
+			return name, defMap, nil
+		}
+	}
+
+	return "", nil, fmt.Errorf("no composite aggregation found in -raw-query")
+}
+
+// compositeSourceNames returns the source field names of a composite aggregation definition, in
+// the order they were declared, so the CSV header is stable.
+func compositeSourceNames(aggDef map[string]interface{}) []string {
+	composite, _ := aggDef["composite"].(map[string]interface{})
+	sources, _ := composite["sources"].([]interface{})
+
+	var names []string
+
+	for _, s := range sources {
+		source, ok := s.(map[string]interface{})
+		if !ok {
+			continue
+		}
+
+		for name := range source {
+			names = append(names, name)
+		}
+	}
+
+	return names
+}
+
+// aggregationHeader builds the CSV header for -aggregations mode: the composite source names, in
+// order, followed by "doc_count" and the configured metric columns.
+func aggregationHeader(aggDef map[string]interface{}, metricPaths []string) []string {
+	header := append([]string{}, compositeSourceNames(aggDef)...)
+	header = append(header, "doc_count")
+
+	for _, path := range metricPaths {
+		header = append(header, metricColumn(path))
+	}
+
+	return header
+}
+
+// metricColumn strips the optional "agg_name>" prefix from a -metrics path, used both for the
+// self-documenting metric flag value, e.g. "my_agg>avg_price.value", and as the resulting CSV
+// column name.
+func metricColumn(path string) string {
+	if idx := strings.Index(path, ">"); idx != -1 {
+		return path[idx+1:]
+	}
+
+	return path
+}
+
+// parseCompositeBucket splits a raw composite bucket into its source key/value pairs, doc_count,
+// and sub-aggregation metrics.
+func parseCompositeBucket(raw map[string]interface{}) CompositeBucket {
+	bucket := CompositeBucket{
+		Key:     map[string]interface{}{},
+		Metrics: map[string]interface{}{},
+	}
+
+	if key, ok := raw["key"].(map[string]interface{}); ok {
+		bucket.Key = key
+	}
+
+	if dc, ok := raw["doc_count"].(float64); ok {
+		bucket.DocCount = int(dc)
+	}
+
+	for k, v := range raw {
+		if k == "key" || k == "doc_count" {
+			continue
+		}
+
+		bucket.Metrics[k] = v
+	}
+
+	return bucket
+}
+
+// bucketRow builds the map used as a ResultHit's _source for one composite bucket, so it can be
+// written out through the same Encoder used for raw hits. For each metric path, the top-level
+// sub-aggregation it names (e.g. "avg_price" in "avg_price.value") is copied into the row
+// unchanged, still nested, so that resolveField(row, column) - called downstream with the exact
+// same column aggregationHeader produced - resolves it the same way it resolves a dotted
+// _source field.
+func bucketRow(bucket CompositeBucket, metricPaths []string) map[string]interface{} {
+	row := map[string]interface{}{}
+
+	for k, v := range bucket.Key {
+		row[k] = v
+	}
+
+	row["doc_count"] = bucket.DocCount
+
+	for _, path := range metricPaths {
+		column := metricColumn(path)
+
+		name := column
+		if idx := strings.Index(column, "."); idx != -1 {
+			name = column[:idx]
+		}
+
+		if v, ok := bucket.Metrics[name]; ok {
+			row[name] = v
+		}
+	}
+
+	return row
+}
+
+// sendAggRequest sends req and decodes it as an AggResponse.
+func sendAggRequest(client *ESClient, req *http.Request) (AggResponse, error) {
+	req.Header.Add("Content-Type", "application/json")
+
+	resp, err := doRequest(client, req, retryConfig)
+	if err != nil {
+		return AggResponse{}, err
+	}
+
+	defer resp.Body.Close()
+
+	body, err := io.ReadAll(resp.Body)
+	if err != nil {
+		return AggResponse{}, err
+	}
+
+	if resp.StatusCode >= 400 {
+		if esErr := parseESError(resp.StatusCode, body); esErr != nil {
+			return AggResponse{}, esErr
+		}
+
+		return AggResponse{}, fmt.Errorf("elasticsearch returned status %d: %s", resp.StatusCode, body)
+	}
+
+	var result AggResponse
+
+	if err := json.Unmarshal(body, &result); err != nil {
+		return AggResponse{}, err
+	}
+
+	return result, nil
+}
@@ -0,0 +1,186 @@
+package main
+
+import (
+	"encoding/csv"
+	"encoding/json"
+	"fmt"
+	"io"
+	"os"
+	"strconv"
+	"strings"
+)
+
+// Encoder writes successive rows of hits out in some format. Implementations are expected to be
+// used for the lifetime of a single export: WriteHeader (if applicable) is called once before
+// the first call to WriteRow.
+type Encoder interface {
+	// WriteHeader writes the given fields as the output's header/column names, if the format has
+	// the concept of one.
+	WriteHeader(fields []string) error
+
+	// WriteRow writes a single hit, resolving each of fields against the hit's _source.
+	WriteRow(fields []string, hit ResultHit) error
+
+	// Close flushes any buffered output and releases the underlying writer, if applicable.
+	Close() error
+}
+
+// CSVOptions configures a CSVEncoder.
+type CSVOptions struct {
+	// Delimiter is the field delimiter to use, e.g. ',' or '\t'.
+	Delimiter rune
+
+	// QuoteAll, when true, quotes every field, not just the ones that require it.
+	QuoteAll bool
+
+	// Null is the string written for fields that are missing or explicitly null.
+	Null string
+
+	// NoHeader, when true, suppresses writing the header row.
+	NoHeader bool
+}
+
+// CSVEncoder is an Encoder that writes properly escaped CSV, using encoding/csv rather than
+// naive string joining.
+type CSVEncoder struct {
+	w    io.Writer
+	cw   *csv.Writer
+	opts CSVOptions
+}
+
+// NewCSVEncoder builds a CSVEncoder that writes to w using the given options.
+func NewCSVEncoder(w io.Writer, opts CSVOptions) *CSVEncoder {
+	cw := csv.NewWriter(w)
+
+	if opts.Delimiter != 0 {
+		cw.Comma = opts.Delimiter
+	}
+
+	return &CSVEncoder{w: w, cw: cw, opts: opts}
+}
+
+// WriteHeader implements Encoder.
+func (e *CSVEncoder) WriteHeader(fields []string) error {
+	if e.opts.NoHeader {
+		return nil
+	}
+
+	return e.writeRecord(fields)
+}
+
+// WriteRow implements Encoder.
+func (e *CSVEncoder) WriteRow(fields []string, hit ResultHit) error {
+	record := make([]string, len(fields))
+
+	for i, field := range fields {
+		v, ok := resolveField(hit.Source, field)
+		if !ok || v == nil {
+			record[i] = e.opts.Null
+			continue
+		}
+
+		cell, err := formatValue(v)
+		if err != nil {
+			return fmt.Errorf("failed to format field %q: %v", field, err)
+		}
+
+		record[i] = cell
+	}
+
+	return e.writeRecord(record)
+}
+
+// Close implements Encoder.
+func (e *CSVEncoder) Close() error {
+	e.cw.Flush()
+	return e.cw.Error()
+}
+
+// writeRecord writes a single CSV record. When QuoteAll is set, every field is quoted
+// regardless of content, which encoding/csv doesn't support directly, so the line is built by
+// hand instead of going through the csv.Writer.
+func (e *CSVEncoder) writeRecord(record []string) error {
+	if !e.opts.QuoteAll {
+		return e.cw.Write(record)
+	}
+
+	quoted := make([]string, len(record))
+	for i, v := range record {
+		quoted[i] = `"` + strings.ReplaceAll(v, `"`, `""`) + `"`
+	}
+
+	delimiter := e.opts.Delimiter
+	if delimiter == 0 {
+		delimiter = ','
+	}
+
+	_, err := fmt.Fprintf(e.w, "%s\r\n", strings.Join(quoted, string(delimiter)))
+	return err
+}
+
+// openOutput opens the destination for -output: stdout for "-" or empty, otherwise the named
+// file, truncated and created if necessary.
+func openOutput(path string) (io.WriteCloser, error) {
+	if path == "" || path == "-" {
+		return nopCloser{os.Stdout}, nil
+	}
+
+	return os.Create(path)
+}
+
+// nopCloser wraps an io.Writer that shouldn't be closed, such as os.Stdout.
+type nopCloser struct {
+	io.Writer
+}
+
+// Close implements io.Closer by doing nothing.
+func (nopCloser) Close() error {
+	return nil
+}
+
+// resolveField resolves a dotted field path, e.g. "user.address.city", against a nested _source
+// map, returning the value and whether it was found.
+func resolveField(source map[string]interface{}, path string) (interface{}, bool) {
+	parts := strings.Split(path, ".")
+
+	var cur interface{} = source
+
+	for _, part := range parts {
+		m, ok := cur.(map[string]interface{})
+		if !ok {
+			return nil, false
+		}
+
+		cur, ok = m[part]
+		if !ok {
+			return nil, false
+		}
+	}
+
+	return cur, true
+}
+
+// formatValue renders a resolved field value as a single CSV cell. Scalars are formatted
+// directly; objects and arrays are JSON-encoded so structure isn't lost.
+func formatValue(v interface{}) (string, error) {
+	switch val := v.(type) {
+	case nil:
+		return "", nil
+	case string:
+		return val, nil
+	case map[string]interface{}, []interface{}:
+		data, err := json.Marshal(val)
+		if err != nil {
+			return "", err
+		}
+
+		return string(data), nil
+	case float64:
+		// encoding/json decodes every JSON number as a float64; formatting with "%v" switches to
+		// scientific notation above ~1e6, corrupting timestamps, large IDs, and counts. Render the
+		// full decimal value instead, with no trailing ".0" for whole numbers.
+		return strconv.FormatFloat(val, 'f', -1, 64), nil
+	default:
+		return fmt.Sprintf("%v", val), nil
+	}
+}
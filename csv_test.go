@@ -0,0 +1,93 @@
+package main
+
+import (
+	"strings"
+	"testing"
+)
+
+func TestResolveField(t *testing.T) {
+	source := map[string]interface{}{
+		"name": "alice",
+		"user": map[string]interface{}{
+			"address": map[string]interface{}{
+				"city": "london",
+			},
+		},
+		"explicit_null": nil,
+	}
+
+	tests := []struct {
+		path   string
+		want   interface{}
+		wantOk bool
+	}{
+		{"name", "alice", true},
+		{"user.address.city", "london", true},
+		{"user.address.missing", nil, false},
+		{"missing", nil, false},
+		{"name.nested", nil, false},
+		{"explicit_null", nil, true},
+	}
+
+	for _, tt := range tests {
+		got, ok := resolveField(source, tt.path)
+		if ok != tt.wantOk || got != tt.want {
+			t.Errorf("resolveField(%q) = (%v, %v), want (%v, %v)", tt.path, got, ok, tt.want, tt.wantOk)
+		}
+	}
+}
+
+func TestFormatValueFloats(t *testing.T) {
+	tests := []struct {
+		in   float64
+		want string
+	}{
+		{1234567, "1234567"},
+		{1732000000000, "1732000000000"},
+		{19.99, "19.99"},
+		{0, "0"},
+	}
+
+	for _, tt := range tests {
+		got, err := formatValue(tt.in)
+		if err != nil {
+			t.Fatalf("formatValue(%v) returned error: %v", tt.in, err)
+		}
+
+		if got != tt.want {
+			t.Errorf("formatValue(%v) = %q, want %q", tt.in, got, tt.want)
+		}
+	}
+}
+
+func TestFormatValueNil(t *testing.T) {
+	got, err := formatValue(nil)
+	if err != nil {
+		t.Fatalf("formatValue(nil) returned error: %v", err)
+	}
+
+	if got != "" {
+		t.Errorf("formatValue(nil) = %q, want \"\"", got)
+	}
+}
+
+func TestWriteRowExplicitNull(t *testing.T) {
+	var buf strings.Builder
+
+	encoder := NewCSVEncoder(&buf, CSVOptions{Null: "NULL", NoHeader: true})
+
+	hit := ResultHit{Source: map[string]interface{}{"optional": nil}}
+
+	if err := encoder.WriteRow([]string{"optional", "missing"}, hit); err != nil {
+		t.Fatalf("WriteRow returned error: %v", err)
+	}
+
+	if err := encoder.Close(); err != nil {
+		t.Fatalf("Close returned error: %v", err)
+	}
+
+	want := "NULL,NULL\n"
+	if buf.String() != want {
+		t.Errorf("WriteRow output = %q, want %q", buf.String(), want)
+	}
+}
@@ -0,0 +1,170 @@
+package main
+
+import (
+	"crypto/tls"
+	"crypto/x509"
+	"encoding/base64"
+	"errors"
+	"fmt"
+	"net/http"
+	"os"
+	"strings"
+)
+
+// ESClientConfig holds the authentication and TLS settings used to build an ESClient.
+type ESClientConfig struct {
+	// CloudID, if set, is decoded into the target host, taking precedence over Host.
+	CloudID string
+
+	// Username and Password enable HTTP basic auth.
+	Username string
+	Password string
+
+	// APIKey is sent as `Authorization: ApiKey <APIKey>`. It's expected to already be in the
+	// base64-encoded `id:api_key` form used by the go-elasticsearch v8 client.
+	APIKey string
+
+	// CACert, ClientCert and ClientKey are paths to PEM-encoded certificates/keys.
+	CACert     string
+	ClientCert string
+	ClientKey  string
+
+	// InsecureSkipVerify disables TLS certificate verification.
+	InsecureSkipVerify bool
+}
+
+// ESClient is an HTTP client configured for talking to an Elasticsearch cluster: it knows how to
+// authenticate requests, and wraps an *http.Client configured with whatever TLS options were
+// given.
+type ESClient struct {
+	// BaseURL is the resolved Elasticsearch endpoint, e.g. "https://my-cluster.es.io:9243".
+	BaseURL string
+
+	httpClient *http.Client
+	username   string
+	password   string
+	apiKey     string
+}
+
+// NewESClient builds an ESClient that talks to host, or to the host decoded from cfg.CloudID if
+// set. Password and API key fallbacks are read from the ELASTICSEARCH_PASSWORD and
+// ELASTICSEARCH_API_KEY environment variables when the corresponding config field is empty, so
+// secrets don't need to be passed on the command line.
+func NewESClient(host string, cfg ESClientConfig) (*ESClient, error) {
+	baseURL := host
+
+	if cfg.CloudID != "" {
+		decoded, err := decodeCloudID(cfg.CloudID)
+		if err != nil {
+			return nil, fmt.Errorf("failed to decode cloud ID: %v", err)
+		}
+
+		baseURL = decoded
+	}
+
+	if baseURL == "" {
+		return nil, errors.New("host must be set")
+	}
+
+	tlsConfig, err := buildTLSConfig(cfg)
+	if err != nil {
+		return nil, err
+	}
+
+	password := cfg.Password
+	if password == "" {
+		password = os.Getenv("ELASTICSEARCH_PASSWORD")
+	}
+
+	apiKey := cfg.APIKey
+	if apiKey == "" {
+		apiKey = os.Getenv("ELASTICSEARCH_API_KEY")
+	}
+
+	return &ESClient{
+		BaseURL: strings.TrimSuffix(baseURL, "/"),
+		httpClient: &http.Client{
+			Transport: &http.Transport{
+				TLSClientConfig: tlsConfig,
+			},
+		},
+		username: cfg.Username,
+		password: password,
+		apiKey:   apiKey,
+	}, nil
+}
+
+// Do sends req, adding whatever authentication the ESClient was configured with.
+func (c *ESClient) Do(req *http.Request) (*http.Response, error) {
+	switch {
+	case c.apiKey != "":
+		req.Header.Set("Authorization", "ApiKey "+c.apiKey)
+	case c.username != "":
+		req.SetBasicAuth(c.username, c.password)
+	}
+
+	return c.httpClient.Do(req)
+}
+
+// buildTLSConfig builds the *tls.Config described by cfg, or nil if no TLS options were given.
+func buildTLSConfig(cfg ESClientConfig) (*tls.Config, error) {
+	if cfg.CACert == "" && cfg.ClientCert == "" && !cfg.InsecureSkipVerify {
+		return nil, nil
+	}
+
+	tlsConfig := &tls.Config{
+		InsecureSkipVerify: cfg.InsecureSkipVerify,
+	}
+
+	if cfg.CACert != "" {
+		pem, err := os.ReadFile(cfg.CACert)
+		if err != nil {
+			return nil, fmt.Errorf("failed to read CA cert: %v", err)
+		}
+
+		pool := x509.NewCertPool()
+		if !pool.AppendCertsFromPEM(pem) {
+			return nil, fmt.Errorf("failed to parse CA cert %q", cfg.CACert)
+		}
+
+		tlsConfig.RootCAs = pool
+	}
+
+	if cfg.ClientCert != "" {
+		if cfg.ClientKey == "" {
+			return nil, errors.New("client-key must be set alongside client-cert")
+		}
+
+		cert, err := tls.LoadX509KeyPair(cfg.ClientCert, cfg.ClientKey)
+		if err != nil {
+			return nil, fmt.Errorf("failed to load client cert/key: %v", err)
+		}
+
+		tlsConfig.Certificates = []tls.Certificate{cert}
+	}
+
+	return tlsConfig, nil
+}
+
+// decodeCloudID decodes an Elastic Cloud ID of the form "name:base64(host$es_uuid$kb_uuid)" into
+// an "https://<es_uuid>.<host>" URL.
+func decodeCloudID(cloudID string) (string, error) {
+	parts := strings.SplitN(cloudID, ":", 2)
+	if len(parts) != 2 {
+		return "", fmt.Errorf("invalid cloud ID: expected \"name:encoded\"")
+	}
+
+	decoded, err := base64.StdEncoding.DecodeString(parts[1])
+	if err != nil {
+		return "", err
+	}
+
+	segments := strings.Split(string(decoded), "$")
+	if len(segments) < 2 || segments[0] == "" || segments[1] == "" {
+		return "", fmt.Errorf("invalid cloud ID: unexpected encoded form")
+	}
+
+	host, esUUID := segments[0], segments[1]
+
+	return fmt.Sprintf("https://%s.%s", esUUID, host), nil
+}
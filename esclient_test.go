@@ -0,0 +1,35 @@
+package main
+
+import (
+	"encoding/base64"
+	"testing"
+)
+
+func TestDecodeCloudID(t *testing.T) {
+	encoded := base64.StdEncoding.EncodeToString([]byte("es.io$abc123$def456"))
+
+	got, err := decodeCloudID("my-deployment:" + encoded)
+	if err != nil {
+		t.Fatalf("decodeCloudID returned error: %v", err)
+	}
+
+	want := "https://abc123.es.io"
+	if got != want {
+		t.Errorf("decodeCloudID() = %q, want %q", got, want)
+	}
+}
+
+func TestDecodeCloudIDInvalid(t *testing.T) {
+	if _, err := decodeCloudID("not-a-cloud-id"); err == nil {
+		t.Error("decodeCloudID(\"not-a-cloud-id\") returned nil error, want one")
+	}
+
+	if _, err := decodeCloudID("name:not-base64!!"); err == nil {
+		t.Error("decodeCloudID with invalid base64 returned nil error, want one")
+	}
+
+	badSegments := base64.StdEncoding.EncodeToString([]byte("onlyonesegment"))
+	if _, err := decodeCloudID("name:" + badSegments); err == nil {
+		t.Error("decodeCloudID with too few segments returned nil error, want one")
+	}
+}
@@ -6,9 +6,11 @@ import (
 	"errors"
 	"flag"
 	"fmt"
+	"io"
 	"log"
 	"net/http"
 	"net/url"
+	"os"
 	"strings"
 	"time"
 )
@@ -26,6 +28,7 @@ var (
 // Result represents the parts of an Elasticsearch result set that we need.
 type Result struct {
 	ScrollID string     `json:"_scroll_id"`
+	PitID    string     `json:"pit_id"`
 	Hits     ResultHits `json:"hits"`
 }
 
@@ -44,6 +47,7 @@ type ResultsTotal struct {
 // ResultHit is an individual result hit, found in a set of ResultHits.
 type ResultHit struct {
 	Source map[string]interface{} `json:"_source"`
+	Sort   []interface{}          `json:"sort"`
 }
 
 func main() {
@@ -52,157 +56,314 @@ func main() {
 	var query string
 	var index string
 	var fields string
-
-	flag.StringVar(&host, "host", "", "The Elasticsearch host, e.g. 'http://localhost:9200'")
+	var pagination string
+	var sort string
+	var checkpointFile string
+	var delimiter string
+	var quoteAll bool
+	var null string
+	var noHeader bool
+	var output string
+	var slices int
+	var workers int
+	var username string
+	var password string
+	var apiKey string
+	var cloudID string
+	var caCert string
+	var clientCert string
+	var clientKey string
+	var insecureSkipVerify bool
+	var maxRetries int
+	var retryBackoff time.Duration
+	var retryOnStatus string
+	var verbose bool
+	var aggregations bool
+	var metrics string
+
+	flag.StringVar(&host, "host", os.Getenv("ELASTICSEARCH_URL"), "The Elasticsearch host, e.g. 'http://localhost:9200'")
 	flag.StringVar(&rawQuery, "raw-query", "", "An Elasticsearch JSON query object")
 	flag.StringVar(&query, "query", "", "A Lucene-syntax search query")
 	flag.StringVar(&fields, "fields", "", "A comma separated list of fields to include")
 	flag.StringVar(&index, "index", "", "An [optional] index to search within")
+	flag.StringVar(&pagination, "pagination", PaginationScroll, "Pagination strategy to use: 'scroll', 'pit', or 'search_after'")
+	flag.StringVar(&sort, "sort", "", "A comma separated list of fields to sort by, used for 'pit'/'search_after' pagination, e.g. 'age:desc,_shard_doc'")
+	flag.StringVar(&checkpointFile, "checkpoint-file", "", "A file to persist pagination progress to, so a crashed export can be resumed")
+	flag.StringVar(&delimiter, "delimiter", ",", "The single-character field delimiter to write")
+	flag.BoolVar(&quoteAll, "quote-all", false, "Quote every field, not just the ones that require it")
+	flag.StringVar(&null, "null", "", "The string to write for fields that are missing or null")
+	flag.BoolVar(&noHeader, "no-header", false, "Don't write a header row")
+	flag.StringVar(&output, "output", "-", "The file to write output to, or '-' for stdout")
+	flag.IntVar(&slices, "slices", 1, "Number of Elasticsearch slices to fetch concurrently")
+	flag.IntVar(&workers, "workers", 0, "Number of concurrent HTTP requests in flight; defaults to -slices")
+	flag.StringVar(&username, "username", "", "Username for HTTP basic auth")
+	flag.StringVar(&password, "password", "", "Password for HTTP basic auth; falls back to ELASTICSEARCH_PASSWORD")
+	flag.StringVar(&apiKey, "api-key", "", "Base64-encoded 'id:api_key' sent as an ApiKey Authorization header; falls back to ELASTICSEARCH_API_KEY")
+	flag.StringVar(&cloudID, "cloud-id", "", "An Elastic Cloud ID, decoded to a host; takes precedence over -host")
+	flag.StringVar(&caCert, "ca-cert", "", "Path to a PEM-encoded CA certificate to verify the server against")
+	flag.StringVar(&clientCert, "client-cert", "", "Path to a PEM-encoded client certificate for mutual TLS")
+	flag.StringVar(&clientKey, "client-key", "", "Path to the PEM-encoded key for -client-cert")
+	flag.BoolVar(&insecureSkipVerify, "insecure-skip-verify", false, "Disable TLS certificate verification")
+	flag.IntVar(&maxRetries, "max-retries", DefaultRetryConfig.MaxRetries, "Maximum number of times to retry a failing request")
+	flag.DurationVar(&retryBackoff, "retry-backoff", DefaultRetryConfig.Backoff, "Base exponential backoff duration between retries")
+	flag.StringVar(&retryOnStatus, "retry-on-status", "", "A comma separated list of HTTP status codes to retry; defaults to 429, 502, 503, 504")
+	flag.BoolVar(&verbose, "verbose", false, "Log outgoing requests and response status codes")
+	flag.BoolVar(&aggregations, "aggregations", false, "Export the buckets of a composite aggregation in -raw-query instead of raw hits")
+	flag.StringVar(&metrics, "metrics", "", "A comma separated list of sub-aggregation metric paths to include as columns, e.g. 'avg_price.value'; only used with -aggregations")
 	flag.Parse()
 
-	if host == "" {
-		fatal(errors.New("host must be set"))
+	if host == "" && cloudID == "" {
+		fatal(errors.New("host or cloud-id must be set"))
 	}
 
 	if rawQuery == "" && query == "" {
 		fatal(errors.New("raw-query or query must be set"))
 	}
 
-	if fields == "" {
+	if aggregations {
+		if rawQuery == "" {
+			fatal(errors.New("-aggregations requires -raw-query"))
+		}
+	} else if fields == "" {
 		fatal(errors.New("fields must be set"))
 	}
 
-	hostURL, err := url.Parse(host)
+	if maxRetries < 0 {
+		fatal(errors.New("max-retries must not be negative"))
+	}
+
+	if pagination == PaginationPIT && index == "" {
+		fatal(errors.New("-index is required when -pagination=pit"))
+	}
+
+	onStatus, err := parseRetryOnStatus(retryOnStatus)
 	if err != nil {
-		fatal(fmt.Errorf("failed to parse host: %s: %v", hostURL, err))
+		fatal(err)
 	}
 
-	filter := strings.Split(fields, ",")
+	retryConfig = RetryConfig{
+		MaxRetries: maxRetries,
+		Backoff:    retryBackoff,
+		OnStatus:   onStatus,
+		Verbose:    verbose,
+	}
 
-	var scrollID string
+	if host != "" {
+		hostURL, err := url.Parse(host)
+		if err != nil {
+			fatal(fmt.Errorf("failed to parse host: %s: %v", host, err))
+		}
+
+		host = hostURL.String()
+	}
+
+	client, err := NewESClient(host, ESClientConfig{
+		CloudID:            cloudID,
+		Username:           username,
+		Password:           password,
+		APIKey:             apiKey,
+		CACert:             caCert,
+		ClientCert:         clientCert,
+		ClientKey:          clientKey,
+		InsecureSkipVerify: insecureSkipVerify,
+	})
+	if err != nil {
+		fatal(err)
+	}
+
+	// The header is exactly the fields the user asked for, in the order they gave them, so it
+	// stays stable across pages even if an early hit is missing one of them. In -aggregations
+	// mode the header instead comes from the composite aggregation itself, so it's left empty
+	// here and filled in by runAggregationExport.
 	var header []string
-	var hitCount int
+	if !aggregations {
+		header = strings.Split(fields, ",")
+	}
 
-	for {
-		result, err := getPage(scrollID, hostURL.String(), index, rawQuery, query)
-		if err != nil && err != ErrNoMorePages {
-			fatal(err)
-		}
+	delimiterRune, err := parseDelimiter(delimiter)
+	if err != nil {
+		fatal(err)
+	}
 
-		hits := result.Hits.Hits
-		hitCount += len(hits)
+	out, err := openOutput(output)
+	if err != nil {
+		fatal(err)
+	}
+
+	defer out.Close()
 
-		// If we're on the first page, let's write the CSV header
-		if scrollID == "" {
-			header = getHeader(hits[0], filter)
-			fmt.Println(strings.Join(header, ","))
+	encoder := NewCSVEncoder(out, CSVOptions{
+		Delimiter: delimiterRune,
+		QuoteAll:  quoteAll,
+		Null:      null,
+		NoHeader:  noHeader,
+	})
+
+	defer func() {
+		if err := encoder.Close(); err != nil {
+			log.Printf("failed to close encoder: %v", err)
 		}
+	}()
 
-		// Print the rest of the results with the fields ordered by the header.
-		for _, h := range hits {
-			var cells []string
+	if aggregations {
+		metricPaths := splitAndTrim(metrics)
 
-			for _, k := range header {
-				var cell string
+		if err := runAggregationExport(client, index, rawQuery, metricPaths, encoder); err != nil {
+			fatal(err)
+		}
 
-				v, ok := h.Source[k]
-				if ok {
-					cell = fmt.Sprintf("%v", v)
-				}
+		return
+	}
 
-				cells = append(cells, cell)
-			}
+	if err := encoder.WriteHeader(header); err != nil {
+		fatal(err)
+	}
 
-			fmt.Println(strings.Join(cells, ","))
-		}
+	err = runExport(ExportConfig{
+		Pagination:     pagination,
+		Client:         client,
+		Index:          index,
+		RawQuery:       rawQuery,
+		Query:          query,
+		Sort:           sort,
+		CheckpointFile: checkpointFile,
+		Slices:         slices,
+		Workers:        workers,
+		Header:         header,
+		Encoder:        encoder,
+	})
+	if err != nil {
+		fatal(err)
+	}
+}
 
-		scrollID = result.ScrollID
+// parseDelimiter turns a -delimiter flag value into a single rune, accepting the literal "\t" as
+// a convenience for shells that can't easily pass a raw tab character.
+func parseDelimiter(s string) (rune, error) {
+	if s == `\t` {
+		return '\t', nil
+	}
 
-		log.Printf("got %d of %d", hitCount, result.Hits.Total.Value)
+	runes := []rune(s)
+	if len(runes) != 1 {
+		return 0, fmt.Errorf("delimiter must be a single character, got %q", s)
+	}
 
-		if len(hits) == int(result.Hits.Total.Value) {
-			break
-		}
+	return runes[0], nil
+}
 
-		if err == ErrNoMorePages {
-			break
-		}
+// newPaginator builds the Paginator for the requested pagination strategy.
+func newPaginator(pagination string, client *ESClient, index, rawQuery, query, sort, checkpointFile string) (Paginator, error) {
+	switch pagination {
+	case PaginationScroll:
+		return NewScrollPaginator(client, index, rawQuery, query, sort, checkpointFile)
+	case PaginationPIT:
+		return NewPITPaginator(client, index, rawQuery, query, sort, checkpointFile)
+	case PaginationSearchAfter:
+		return NewSearchAfterPaginator(client, index, rawQuery, query, sort, checkpointFile)
+	default:
+		return nil, fmt.Errorf("unknown pagination strategy: %q", pagination)
 	}
 }
 
-// getPage returns the next page of results.
-func getPage(scrollID, host, index, rawQuery, query string) (Result, error) {
-	if scrollID == "" {
-		return getFirstPage(host, index, rawQuery, query)
+// getFirstPage gets the first page of results, starting a scroll context. sort and searchAfter
+// are normally empty; they're only used when a scroll is being reissued after expiring, to skip
+// past hits already seen.
+func getFirstPage(client *ESClient, index, rawQuery, query string, sort []map[string]string, searchAfter []interface{}) (Result, error) {
+	searchURL := fmt.Sprintf("%s/_search", client.BaseURL)
+	if index != "" {
+		searchURL = fmt.Sprintf("%s/%s/_search?scroll=2m", client.BaseURL, index)
 	}
 
-	searchURL := fmt.Sprintf("%s/_search/scroll", host)
-	reqBody := strings.NewReader(fmt.Sprintf(`
-		{
-			"scroll": "2m",
-			"scroll_id": "%s"
-		}
-	`, scrollID))
+	reqBody, err := buildFirstPageBody(rawQuery, query, sort, searchAfter)
+	if err != nil {
+		return Result{}, err
+	}
 
-	req, err := http.NewRequest("POST", searchURL, reqBody)
+	req, err := http.NewRequest("POST", searchURL, strings.NewReader(reqBody))
 	if err != nil {
 		return Result{}, err
 	}
 
-	return sendAndDecode(req)
+	return sendAndDecode(client, req)
 }
 
-// getFirstPage gets the first page of results.
-func getFirstPage(host, index, rawQuery, query string) (Result, error) {
-	searchURL := fmt.Sprintf("%s/_search", host)
-	if index != "" {
-		searchURL = fmt.Sprintf("%s/%s/_search?scroll=2m", host, index)
+// buildFirstPageBody builds the request body for the first page of a query, preserving the
+// historical "size: 10000" default for plain -query Lucene searches, and merging in a sort
+// and/or search_after clause when given.
+func buildFirstPageBody(rawQuery, query string, sort []map[string]string, searchAfter []interface{}) (string, error) {
+	if rawQuery == "" && query == "" {
+		return "", nil
+	}
+
+	if rawQuery != "" && len(sort) == 0 && len(searchAfter) == 0 {
+		return rawQuery, nil
 	}
 
-	var reqBody string
+	body := map[string]interface{}{}
 
 	if rawQuery != "" {
-		reqBody = rawQuery
-	} else if query != "" {
-		reqBody = fmt.Sprintf(`
-			{
-				"size": 10000,
-				"query": {
-					"query_string": {
-						"query": "%s"
-					}
-				}
-			}
-		`, query)
+		if err := json.Unmarshal([]byte(rawQuery), &body); err != nil {
+			return "", err
+		}
+	} else {
+		body["size"] = 10000
+		body["query"] = map[string]interface{}{
+			"query_string": map[string]string{
+				"query": query,
+			},
+		}
 	}
 
-	req, err := http.NewRequest("POST", searchURL, strings.NewReader(reqBody))
+	if len(sort) != 0 {
+		body["sort"] = sort
+	}
+
+	if len(searchAfter) != 0 {
+		body["search_after"] = searchAfter
+	}
+
+	data, err := json.Marshal(body)
 	if err != nil {
-		return Result{}, err
+		return "", err
 	}
 
-	return sendAndDecode(req)
+	return string(data), nil
 }
 
-// sendAndDecode sends the given request and decodes the resulting response body.
-func sendAndDecode(req *http.Request) (Result, error) {
+// sendAndDecode sends the given request through client, retrying as configured, and decodes the
+// resulting response body. If Elasticsearch responds with an error, it's parsed into an *ESError
+// so callers see the actual reason rather than an opaque decode failure.
+func sendAndDecode(client *ESClient, req *http.Request) (Result, error) {
 	ctx, cfn := context.WithTimeout(context.Background(), Timeout)
 	defer cfn()
 
 	req = req.WithContext(ctx)
 	req.Header.Add("Content-Type", "application/json")
 
-	resp, err := http.DefaultClient.Do(req)
+	resp, err := doRequest(client, req, retryConfig)
 	if err != nil {
 		return Result{}, err
 	}
 
 	defer resp.Body.Close()
 
+	body, err := io.ReadAll(resp.Body)
+	if err != nil {
+		return Result{}, err
+	}
+
+	if resp.StatusCode >= 400 {
+		if esErr := parseESError(resp.StatusCode, body); esErr != nil {
+			return Result{}, esErr
+		}
+
+		return Result{}, fmt.Errorf("elasticsearch returned status %d: %s", resp.StatusCode, body)
+	}
+
 	var result Result
 
-	err = json.NewDecoder(resp.Body).Decode(&result)
-	if err != nil {
+	if err := json.Unmarshal(body, &result); err != nil {
 		return Result{}, err
 	}
 
@@ -220,30 +381,3 @@ func fatal(err error) {
 		log.Fatalf("fatal: %v\n", err)
 	}
 }
-
-// getHeader gets the header strings for the results. The given fields will be used to filter the
-// keys on the given ResultHit it's not an empty slice of strings.
-func getHeader(hit ResultHit, fields []string) []string {
-	var header []string
-
-	for k := range hit.Source {
-		if len(fields) != 0 && !stringSliceContains(fields, k) {
-			continue
-		}
-
-		header = append(header, k)
-	}
-
-	return header
-}
-
-// stringSliceContains returns true if the given string slice contains the given string.
-func stringSliceContains(strs []string, str string) bool {
-	for _, s := range strs {
-		if s == str {
-			return true
-		}
-	}
-
-	return false
-}
@@ -0,0 +1,508 @@
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"log"
+	"net/http"
+	"os"
+	"strings"
+)
+
+// PaginationScroll uses the deprecated `_search/scroll` API to page through results.
+const PaginationScroll = "scroll"
+
+// PaginationPIT uses a Point-in-Time (PIT) plus `search_after` to page through results. This
+// works beyond `index.max_result_window` and is the recommended approach on newer Elasticsearch
+// versions where scroll is discouraged.
+const PaginationPIT = "pit"
+
+// PaginationSearchAfter uses plain `search_after` (with no PIT) to page through results.
+const PaginationSearchAfter = "search_after"
+
+// DefaultSort is the sort used when none is given for PIT/search_after pagination. `_shard_doc`
+// is a cheap, always-present tiebreaker recommended by Elasticsearch for PIT pagination.
+const DefaultSort = "_shard_doc"
+
+// PITKeepAlive is how long a PIT is kept open between requests.
+const PITKeepAlive = "2m"
+
+// Paginator fetches successive pages of hits from Elasticsearch.
+type Paginator interface {
+	// Next returns the next page of results. It returns ErrNoMorePages, possibly alongside a
+	// final (empty) Result, once there are no more pages to fetch.
+	Next() (Result, error)
+
+	// Close releases any server-side resources held by the paginator, e.g. scroll contexts or
+	// PITs. It's safe to call Close even if no resources were ever allocated.
+	Close() error
+}
+
+// Checkpoint is the state persisted between pages so that a crashed or interrupted export can be
+// resumed from the last successfully written page.
+type Checkpoint struct {
+	PITID       string        `json:"pit_id,omitempty"`
+	ScrollID    string        `json:"scroll_id,omitempty"`
+	SearchAfter []interface{} `json:"search_after,omitempty"`
+}
+
+// loadCheckpoint reads a Checkpoint from the given path. A missing file is not an error; it just
+// means there's nothing to resume from.
+func loadCheckpoint(path string) (Checkpoint, error) {
+	var cp Checkpoint
+
+	if path == "" {
+		return cp, nil
+	}
+
+	data, err := os.ReadFile(path)
+	if err != nil {
+		if os.IsNotExist(err) {
+			return cp, nil
+		}
+
+		return cp, err
+	}
+
+	if err := json.Unmarshal(data, &cp); err != nil {
+		return cp, err
+	}
+
+	return cp, nil
+}
+
+// writeCheckpoint persists the given Checkpoint to path. It's a no-op when path is empty.
+func writeCheckpoint(path string, cp Checkpoint) error {
+	if path == "" {
+		return nil
+	}
+
+	data, err := json.Marshal(cp)
+	if err != nil {
+		return err
+	}
+
+	return os.WriteFile(path, data, 0644)
+}
+
+// parseSort turns a comma separated `-sort` flag value, e.g. "age:desc,_shard_doc", into the
+// sort clause Elasticsearch expects in a request body.
+func parseSort(sort string) []map[string]string {
+	if sort == "" {
+		sort = DefaultSort
+	}
+
+	var clauses []map[string]string
+
+	for _, field := range strings.Split(sort, ",") {
+		field = strings.TrimSpace(field)
+		if field == "" {
+			continue
+		}
+
+		order := "asc"
+		if parts := strings.SplitN(field, ":", 2); len(parts) == 2 {
+			field, order = parts[0], parts[1]
+		}
+
+		clauses = append(clauses, map[string]string{field: order})
+	}
+
+	return clauses
+}
+
+// ScrollPaginator implements Paginator using the `_search/scroll` API.
+type ScrollPaginator struct {
+	client                                      *ESClient
+	index, rawQuery, query, sort, checkpointFile string
+
+	scrollID string
+	lastSort []interface{}
+	started  bool
+}
+
+// NewScrollPaginator builds a ScrollPaginator, resuming from checkpointFile if it exists. sort is
+// optional; when given, it's used to fast-forward past already-seen hits if the scroll expires
+// mid-export.
+func NewScrollPaginator(client *ESClient, index, rawQuery, query, sort, checkpointFile string) (*ScrollPaginator, error) {
+	cp, err := loadCheckpoint(checkpointFile)
+	if err != nil {
+		return nil, err
+	}
+
+	return &ScrollPaginator{
+		client:         client,
+		index:          index,
+		rawQuery:       rawQuery,
+		query:          query,
+		sort:           sort,
+		checkpointFile: checkpointFile,
+		scrollID:       cp.ScrollID,
+		lastSort:       cp.SearchAfter,
+		started:        cp.ScrollID != "",
+	}, nil
+}
+
+// Next implements Paginator.
+func (p *ScrollPaginator) Next() (Result, error) {
+	var result Result
+	var err error
+
+	if !p.started {
+		p.started = true
+		result, err = getFirstPage(p.client, p.index, p.rawQuery, p.query, p.sortClause(), p.lastSort)
+	} else {
+		result, err = getScrollPage(p.client, p.scrollID)
+
+		if isSearchContextMissing(err) {
+			log.Printf("scroll expired, reissuing initial query")
+			result, err = p.reissue()
+		}
+	}
+
+	if err != nil && err != ErrNoMorePages {
+		return result, err
+	}
+
+	p.scrollID = result.ScrollID
+
+	if sort := lastSort(result); len(sort) != 0 {
+		p.lastSort = sort
+	}
+
+	if cpErr := writeCheckpoint(p.checkpointFile, Checkpoint{ScrollID: p.scrollID, SearchAfter: p.lastSort}); cpErr != nil {
+		return result, cpErr
+	}
+
+	return result, err
+}
+
+// reissue opens a fresh scroll after the previous one expired. If sort was configured, the
+// search_after value of the last hit we saw is used to skip straight past already-seen results;
+// otherwise the export restarts from the beginning.
+func (p *ScrollPaginator) reissue() (Result, error) {
+	return getFirstPage(p.client, p.index, p.rawQuery, p.query, p.sortClause(), p.lastSort)
+}
+
+// sortClause returns the sort clause to use for this scroll, which is only built when the user
+// configured one, since scroll doesn't otherwise need one.
+func (p *ScrollPaginator) sortClause() []map[string]string {
+	if p.sort == "" {
+		return nil
+	}
+
+	return parseSort(p.sort)
+}
+
+// isSearchContextMissing returns true if err is an *ESError reporting that the scroll context
+// has expired.
+func isSearchContextMissing(err error) bool {
+	esErr, ok := err.(*ESError)
+	return ok && esErr.Type == ErrSearchContextMissing
+}
+
+// Close implements Paginator. Elasticsearch scroll contexts expire on their own, so there's
+// nothing to clean up here.
+func (p *ScrollPaginator) Close() error {
+	return nil
+}
+
+// getScrollPage fetches the next page of a scroll using the given scroll ID.
+func getScrollPage(client *ESClient, scrollID string) (Result, error) {
+	searchURL := fmt.Sprintf("%s/_search/scroll", client.BaseURL)
+	reqBody := strings.NewReader(fmt.Sprintf(`
+		{
+			"scroll": "2m",
+			"scroll_id": "%s"
+		}
+	`, scrollID))
+
+	req, err := http.NewRequest("POST", searchURL, reqBody)
+	if err != nil {
+		return Result{}, err
+	}
+
+	return sendAndDecode(client, req)
+}
+
+// PITPaginator implements Paginator using a Point-in-Time plus `search_after`.
+type PITPaginator struct {
+	client                                  *ESClient
+	index, rawQuery, query, checkpointFile string
+	sort                                    []map[string]string
+
+	pitID       string
+	searchAfter []interface{}
+	started     bool
+}
+
+// NewPITPaginator builds a PITPaginator, resuming from checkpointFile if it exists. If no
+// checkpoint is found, a fresh PIT is opened on the first call to Next.
+func NewPITPaginator(client *ESClient, index, rawQuery, query, sort, checkpointFile string) (*PITPaginator, error) {
+	cp, err := loadCheckpoint(checkpointFile)
+	if err != nil {
+		return nil, err
+	}
+
+	return &PITPaginator{
+		client:         client,
+		index:          index,
+		rawQuery:       rawQuery,
+		query:          query,
+		checkpointFile: checkpointFile,
+		sort:           parseSort(sort),
+		pitID:          cp.PITID,
+		searchAfter:    cp.SearchAfter,
+		started:        cp.PITID != "",
+	}, nil
+}
+
+// Next implements Paginator.
+func (p *PITPaginator) Next() (Result, error) {
+	if !p.started {
+		pitID, err := openPIT(p.client, p.index)
+		if err != nil {
+			return Result{}, err
+		}
+
+		p.pitID = pitID
+		p.started = true
+	}
+
+	result, pitID, searchAfter, err := searchWithPIT(p.client, p.pitID, p.rawQuery, p.query, p.sort, p.searchAfter)
+	if err != nil && err != ErrNoMorePages {
+		return result, err
+	}
+
+	if pitID != "" {
+		p.pitID = pitID
+	}
+
+	p.searchAfter = searchAfter
+
+	cpErr := writeCheckpoint(p.checkpointFile, Checkpoint{PITID: p.pitID, SearchAfter: p.searchAfter})
+	if cpErr != nil {
+		return result, cpErr
+	}
+
+	return result, err
+}
+
+// Close implements Paginator, closing the underlying PIT.
+func (p *PITPaginator) Close() error {
+	if p.pitID == "" {
+		return nil
+	}
+
+	return closePIT(p.client, p.pitID)
+}
+
+// SearchAfterPaginator implements Paginator using plain `search_after`, without a PIT. This
+// doesn't give a true point-in-time view, but avoids the extra PIT lifecycle when callers are
+// happy to accept that tradeoff.
+type SearchAfterPaginator struct {
+	client                                *ESClient
+	index, rawQuery, query, checkpointFile string
+	sort                                    []map[string]string
+
+	searchAfter []interface{}
+	started     bool
+}
+
+// NewSearchAfterPaginator builds a SearchAfterPaginator, resuming from checkpointFile if it exists.
+func NewSearchAfterPaginator(client *ESClient, index, rawQuery, query, sort, checkpointFile string) (*SearchAfterPaginator, error) {
+	cp, err := loadCheckpoint(checkpointFile)
+	if err != nil {
+		return nil, err
+	}
+
+	return &SearchAfterPaginator{
+		client:         client,
+		index:          index,
+		rawQuery:       rawQuery,
+		query:          query,
+		checkpointFile: checkpointFile,
+		sort:           parseSort(sort),
+		searchAfter:    cp.SearchAfter,
+		started:        len(cp.SearchAfter) != 0,
+	}, nil
+}
+
+// Next implements Paginator.
+func (p *SearchAfterPaginator) Next() (Result, error) {
+	result, searchAfter, err := searchWithSearchAfter(p.client, p.index, p.rawQuery, p.query, p.sort, p.searchAfter)
+	if err != nil && err != ErrNoMorePages {
+		return result, err
+	}
+
+	p.searchAfter = searchAfter
+	p.started = true
+
+	if cpErr := writeCheckpoint(p.checkpointFile, Checkpoint{SearchAfter: p.searchAfter}); cpErr != nil {
+		return result, cpErr
+	}
+
+	return result, err
+}
+
+// Close implements Paginator. There's no server-side resource to release.
+func (p *SearchAfterPaginator) Close() error {
+	return nil
+}
+
+// openPIT opens a new Point-in-Time against index and returns its ID.
+func openPIT(client *ESClient, index string) (string, error) {
+	pitURL := fmt.Sprintf("%s/%s/_pit?keep_alive=%s", client.BaseURL, index, PITKeepAlive)
+
+	req, err := http.NewRequest("POST", pitURL, nil)
+	if err != nil {
+		return "", err
+	}
+
+	req.Header.Add("Content-Type", "application/json")
+
+	resp, err := doRequest(client, req, retryConfig)
+	if err != nil {
+		return "", err
+	}
+
+	defer resp.Body.Close()
+
+	var body struct {
+		ID string `json:"id"`
+	}
+
+	if err := json.NewDecoder(resp.Body).Decode(&body); err != nil {
+		return "", err
+	}
+
+	return body.ID, nil
+}
+
+// closePIT closes the PIT with the given ID.
+func closePIT(client *ESClient, pitID string) error {
+	reqBody := strings.NewReader(fmt.Sprintf(`{"id": %q}`, pitID))
+
+	req, err := http.NewRequest("DELETE", fmt.Sprintf("%s/_pit", client.BaseURL), reqBody)
+	if err != nil {
+		return err
+	}
+
+	req.Header.Add("Content-Type", "application/json")
+
+	resp, err := doRequest(client, req, retryConfig)
+	if err != nil {
+		return err
+	}
+
+	defer resp.Body.Close()
+
+	return nil
+}
+
+// searchWithPIT issues a single `_search` request carrying the given PIT and search_after value,
+// and returns the result along with the (possibly refreshed) PIT ID and the search_after value
+// to use for the next page.
+func searchWithPIT(client *ESClient, pitID, rawQuery, query string, sort []map[string]string, searchAfter []interface{}) (Result, string, []interface{}, error) {
+	body, err := buildPagedRequestBody(rawQuery, query, sort, searchAfter)
+	if err != nil {
+		return Result{}, "", nil, err
+	}
+
+	body["pit"] = map[string]string{
+		"id":         pitID,
+		"keep_alive": PITKeepAlive,
+	}
+
+	data, err := json.Marshal(body)
+	if err != nil {
+		return Result{}, "", nil, err
+	}
+
+	req, err := http.NewRequest("POST", fmt.Sprintf("%s/_search", client.BaseURL), strings.NewReader(string(data)))
+	if err != nil {
+		return Result{}, "", nil, err
+	}
+
+	result, err := sendAndDecode(client, req)
+	if err != nil && err != ErrNoMorePages {
+		return result, "", nil, err
+	}
+
+	return result, result.PitID, lastSort(result), err
+}
+
+// searchWithSearchAfter issues a single `_search` request against index carrying the given
+// search_after value, and returns the result along with the search_after value for the next page.
+func searchWithSearchAfter(client *ESClient, index, rawQuery, query string, sort []map[string]string, searchAfter []interface{}) (Result, []interface{}, error) {
+	body, err := buildPagedRequestBody(rawQuery, query, sort, searchAfter)
+	if err != nil {
+		return Result{}, nil, err
+	}
+
+	data, err := json.Marshal(body)
+	if err != nil {
+		return Result{}, nil, err
+	}
+
+	searchURL := fmt.Sprintf("%s/_search", client.BaseURL)
+	if index != "" {
+		searchURL = fmt.Sprintf("%s/%s/_search", client.BaseURL, index)
+	}
+
+	req, err := http.NewRequest("POST", searchURL, strings.NewReader(string(data)))
+	if err != nil {
+		return Result{}, nil, err
+	}
+
+	result, err := sendAndDecode(client, req)
+	if err != nil && err != ErrNoMorePages {
+		return result, nil, err
+	}
+
+	return result, lastSort(result), err
+}
+
+// buildPagedRequestBody merges the user's raw query or Lucene query with the sort and
+// search_after clauses required for PIT/search_after pagination.
+func buildPagedRequestBody(rawQuery, query string, sort []map[string]string, searchAfter []interface{}) (map[string]interface{}, error) {
+	body := map[string]interface{}{}
+
+	if rawQuery != "" {
+		if err := json.Unmarshal([]byte(rawQuery), &body); err != nil {
+			return nil, err
+		}
+	} else if query != "" {
+		body["query"] = map[string]interface{}{
+			"query_string": map[string]string{
+				"query": query,
+			},
+		}
+	}
+
+	// Elasticsearch defaults to a page size of 10 when none is given, which would make PIT/
+	// search_after pagination take roughly 1000x as many round trips as the scroll path's
+	// historical "size: 10000" default. Preserve that default here too, unless the raw query
+	// already set its own.
+	if _, ok := body["size"]; !ok {
+		body["size"] = 10000
+	}
+
+	body["sort"] = sort
+
+	if len(searchAfter) != 0 {
+		body["search_after"] = searchAfter
+	}
+
+	return body, nil
+}
+
+// lastSort returns the sort values of the last hit in result, for use as the next search_after.
+func lastSort(result Result) []interface{} {
+	hits := result.Hits.Hits
+	if len(hits) == 0 {
+		return nil
+	}
+
+	return hits[len(hits)-1].Sort
+}
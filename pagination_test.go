@@ -0,0 +1,57 @@
+package main
+
+import "testing"
+
+func TestParseSort(t *testing.T) {
+	got := parseSort("age:desc,_shard_doc")
+	want := []map[string]string{
+		{"age": "desc"},
+		{"_shard_doc": "asc"},
+	}
+
+	if len(got) != len(want) {
+		t.Fatalf("parseSort() = %v, want %v", got, want)
+	}
+
+	for i := range want {
+		for k, v := range want[i] {
+			if got[i][k] != v {
+				t.Errorf("parseSort()[%d] = %v, want %v", i, got[i], want[i])
+			}
+		}
+	}
+}
+
+func TestParseSortDefault(t *testing.T) {
+	got := parseSort("")
+	if len(got) != 1 || got[0][DefaultSort] != "asc" {
+		t.Errorf("parseSort(\"\") = %v, want default sort %q", got, DefaultSort)
+	}
+}
+
+func TestBuildPagedRequestBodyDefaultsSize(t *testing.T) {
+	body, err := buildPagedRequestBody("", "some query", parseSort(""), nil)
+	if err != nil {
+		t.Fatalf("buildPagedRequestBody returned error: %v", err)
+	}
+
+	size, ok := body["size"]
+	if !ok {
+		t.Fatal("buildPagedRequestBody did not set a default size")
+	}
+
+	if size != 10000 {
+		t.Errorf("buildPagedRequestBody size = %v, want 10000", size)
+	}
+}
+
+func TestBuildPagedRequestBodyPreservesExplicitSize(t *testing.T) {
+	body, err := buildPagedRequestBody(`{"size": 250}`, "", parseSort(""), nil)
+	if err != nil {
+		t.Fatalf("buildPagedRequestBody returned error: %v", err)
+	}
+
+	if body["size"] != float64(250) {
+		t.Errorf("buildPagedRequestBody size = %v, want 250", body["size"])
+	}
+}
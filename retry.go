@@ -0,0 +1,215 @@
+package main
+
+import (
+	"bytes"
+	"encoding/json"
+	"fmt"
+	"io"
+	"log"
+	"math/rand"
+	"net/http"
+	"net/http/httputil"
+	"time"
+)
+
+// ESError is a typed Elasticsearch error response, e.g.:
+//
+//	{"error": {"type": "...", "reason": "...", "root_cause": [...]}}
+type ESError struct {
+	Status    int           `json:"-"`
+	Type      string        `json:"type"`
+	Reason    string        `json:"reason"`
+	RootCause []ESRootCause `json:"root_cause"`
+}
+
+// ESRootCause is one entry of an ESError's root_cause list.
+type ESRootCause struct {
+	Type   string `json:"type"`
+	Reason string `json:"reason"`
+}
+
+// Error implements the error interface.
+func (e *ESError) Error() string {
+	return fmt.Sprintf("elasticsearch: %s: %s (status %d)", e.Type, e.Reason, e.Status)
+}
+
+// ErrSearchContextMissing is the ESError.Type Elasticsearch returns when a scroll has expired.
+const ErrSearchContextMissing = "search_context_missing_exception"
+
+// RetryConfig controls how failed requests are retried.
+type RetryConfig struct {
+	// MaxRetries is the maximum number of times to retry a failing request.
+	MaxRetries int
+
+	// Backoff is the base duration to wait before the first retry; each subsequent retry
+	// doubles it, plus jitter.
+	Backoff time.Duration
+
+	// OnStatus is the set of HTTP status codes that should be retried, in addition to network
+	// errors.
+	OnStatus map[int]bool
+
+	// Verbose, when true, dumps outgoing requests and response status codes.
+	Verbose bool
+}
+
+// retryConfig is the RetryConfig used for every request; main sets it from flags before the
+// export begins.
+var retryConfig = DefaultRetryConfig
+
+// DefaultRetryConfig is used when no retry flags are given.
+var DefaultRetryConfig = RetryConfig{
+	MaxRetries: 3,
+	Backoff:    500 * time.Millisecond,
+	OnStatus: map[int]bool{
+		http.StatusTooManyRequests:    true,
+		http.StatusBadGateway:         true,
+		http.StatusServiceUnavailable: true,
+		http.StatusGatewayTimeout:     true,
+	},
+}
+
+// parseRetryOnStatus parses a comma separated `-retry-on-status` flag value into the set of
+// status codes doRequest should retry.
+func parseRetryOnStatus(csv string) (map[int]bool, error) {
+	if csv == "" {
+		return DefaultRetryConfig.OnStatus, nil
+	}
+
+	statuses := map[int]bool{}
+
+	for _, s := range splitAndTrim(csv) {
+		var code int
+		if _, err := fmt.Sscanf(s, "%d", &code); err != nil {
+			return nil, fmt.Errorf("invalid status code %q: %v", s, err)
+		}
+
+		statuses[code] = true
+	}
+
+	return statuses, nil
+}
+
+// splitAndTrim splits a comma separated string and trims whitespace from each part.
+func splitAndTrim(s string) []string {
+	var parts []string
+
+	for _, p := range bytes.Split([]byte(s), []byte(",")) {
+		p = bytes.TrimSpace(p)
+		if len(p) != 0 {
+			parts = append(parts, string(p))
+		}
+	}
+
+	return parts
+}
+
+// doRequest sends req through client, retrying transient failures (network errors and the
+// configured retryable status codes) with exponential backoff and jitter. req.GetBody must be
+// set if the request has a body, so it can be replayed on retry; this holds for requests built
+// with strings.NewReader/bytes.NewReader bodies, as this package uses throughout.
+func doRequest(client *ESClient, req *http.Request, cfg RetryConfig) (*http.Response, error) {
+	var lastErr error
+
+	for attempt := 0; ; attempt++ {
+		if attempt > 0 {
+			if req.GetBody != nil {
+				body, err := req.GetBody()
+				if err != nil {
+					return nil, err
+				}
+
+				req.Body = body
+			}
+
+			time.Sleep(backoffDuration(cfg.Backoff, attempt))
+		}
+
+		if cfg.Verbose {
+			dumpRequest(req)
+		}
+
+		resp, err := client.Do(req)
+		if err != nil {
+			lastErr = err
+
+			if attempt >= cfg.MaxRetries {
+				break
+			}
+
+			continue
+		}
+
+		if cfg.Verbose {
+			log.Printf("-> %s %s: %d", req.Method, req.URL, resp.StatusCode)
+		}
+
+		if !cfg.OnStatus[resp.StatusCode] {
+			return resp, nil
+		}
+
+		body, readErr := io.ReadAll(resp.Body)
+		resp.Body.Close()
+
+		if readErr != nil {
+			lastErr = fmt.Errorf("received retryable status %d from %s (failed to read body: %v)", resp.StatusCode, req.URL, readErr)
+		} else if esErr := parseESError(resp.StatusCode, body); esErr != nil {
+			lastErr = esErr
+		} else {
+			lastErr = fmt.Errorf("received retryable status %d from %s: %s", resp.StatusCode, req.URL, body)
+		}
+
+		if attempt >= cfg.MaxRetries {
+			break
+		}
+	}
+
+	return nil, lastErr
+}
+
+// backoffDuration returns the exponential backoff duration for the given attempt (1-indexed),
+// with up to 50% jitter added to avoid a thundering herd of retries.
+func backoffDuration(base time.Duration, attempt int) time.Duration {
+	d := base << uint(attempt-1)
+	jitter := time.Duration(rand.Int63n(int64(d)/2 + 1))
+
+	return d + jitter
+}
+
+// dumpRequest logs an outgoing request's method, URL, headers and body.
+func dumpRequest(req *http.Request) {
+	dump, err := httputil.DumpRequest(req, true)
+	if err != nil {
+		log.Printf("failed to dump request: %v", err)
+		return
+	}
+
+	log.Printf("request:\n%s", dump)
+}
+
+// parseESError attempts to parse body as an Elasticsearch error response, returning nil if it
+// doesn't look like one.
+func parseESError(status int, body []byte) *ESError {
+	var wrapper struct {
+		Error json.RawMessage `json:"error"`
+	}
+
+	if err := json.Unmarshal(body, &wrapper); err != nil || len(wrapper.Error) == 0 {
+		return nil
+	}
+
+	// The "error" field is sometimes a plain string rather than an object.
+	var esErr ESError
+	if err := json.Unmarshal(wrapper.Error, &esErr); err != nil {
+		var reason string
+		if err := json.Unmarshal(wrapper.Error, &reason); err != nil {
+			return nil
+		}
+
+		esErr.Reason = reason
+	}
+
+	esErr.Status = status
+
+	return &esErr
+}
@@ -0,0 +1,79 @@
+package main
+
+import (
+	"net/http"
+	"net/http/httptest"
+	"testing"
+	"time"
+)
+
+func TestDoRequestNegativeMaxRetriesDoesNotPanic(t *testing.T) {
+	srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.WriteHeader(http.StatusServiceUnavailable)
+	}))
+	defer srv.Close()
+
+	client := &ESClient{BaseURL: srv.URL, httpClient: srv.Client()}
+
+	req, err := http.NewRequest("GET", srv.URL, nil)
+	if err != nil {
+		t.Fatalf("http.NewRequest returned error: %v", err)
+	}
+
+	cfg := RetryConfig{
+		MaxRetries: -1,
+		OnStatus:   map[int]bool{http.StatusServiceUnavailable: true},
+	}
+
+	resp, err := doRequest(client, req, cfg)
+	if err == nil {
+		t.Fatal("doRequest returned a nil error, want one describing the failed request")
+	}
+
+	if resp != nil {
+		t.Errorf("doRequest returned a non-nil response alongside an error: %v", resp)
+	}
+}
+
+func TestParseESErrorObject(t *testing.T) {
+	body := []byte(`{"error": {"type": "search_context_missing_exception", "reason": "No search context found", "root_cause": [{"type": "x", "reason": "y"}]}}`)
+
+	esErr := parseESError(404, body)
+	if esErr == nil {
+		t.Fatal("parseESError returned nil")
+	}
+
+	if esErr.Type != "search_context_missing_exception" || esErr.Status != 404 {
+		t.Errorf("parseESError = %+v, want type search_context_missing_exception, status 404", esErr)
+	}
+}
+
+func TestParseESErrorString(t *testing.T) {
+	body := []byte(`{"error": "something went wrong"}`)
+
+	esErr := parseESError(500, body)
+	if esErr == nil || esErr.Reason != "something went wrong" {
+		t.Errorf("parseESError = %+v, want reason %q", esErr, "something went wrong")
+	}
+}
+
+func TestParseESErrorNotAnError(t *testing.T) {
+	if esErr := parseESError(200, []byte(`{"hits": {}}`)); esErr != nil {
+		t.Errorf("parseESError = %+v, want nil", esErr)
+	}
+}
+
+func TestBackoffDurationGrows(t *testing.T) {
+	base := 100 * time.Millisecond
+
+	first := backoffDuration(base, 1)
+	second := backoffDuration(base, 2)
+
+	if first < base || first > base*3/2 {
+		t.Errorf("backoffDuration(base, 1) = %v, want within [%v, %v]", first, base, base*3/2)
+	}
+
+	if second < base*2 {
+		t.Errorf("backoffDuration(base, 2) = %v, want at least %v", second, base*2)
+	}
+}
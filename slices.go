@@ -0,0 +1,197 @@
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"log"
+	"sync"
+	"sync/atomic"
+)
+
+// DefaultPageBuffer is the number of fetched-but-not-yet-written pages the export pipeline will
+// buffer before producers block, providing backpressure against slow disks.
+const DefaultPageBuffer = 4
+
+// slicePage is a single page of hits, tagged with which slice produced it.
+type slicePage struct {
+	sliceID int
+	result  Result
+	err     error
+}
+
+// ExportConfig holds everything needed to run an export, parallelised across slices.
+type ExportConfig struct {
+	Pagination     string
+	Client         *ESClient
+	Index          string
+	RawQuery       string
+	Query          string
+	Sort           string
+	CheckpointFile string
+	Slices         int
+	Workers        int
+	Header         []string
+	Encoder        Encoder
+}
+
+// runExport fetches every page of the query, writing rows through cfg.Encoder as they arrive.
+// With cfg.Slices > 1, it opens one paginator per Elasticsearch slice and fetches them
+// concurrently, bounded by cfg.Workers in-flight HTTP requests, feeding a bounded channel of
+// pages that a single writer goroutine drains in order to keep the encoder's output well formed.
+func runExport(cfg ExportConfig) error {
+	if cfg.Slices < 1 {
+		cfg.Slices = 1
+	}
+
+	if cfg.Workers < 1 {
+		cfg.Workers = cfg.Slices
+	}
+
+	paginators := make([]Paginator, cfg.Slices)
+
+	for i := 0; i < cfg.Slices; i++ {
+		rawQuery, query, err := withSlice(cfg.RawQuery, cfg.Query, i, cfg.Slices)
+		if err != nil {
+			return err
+		}
+
+		checkpointFile := cfg.CheckpointFile
+		if checkpointFile != "" && cfg.Slices > 1 {
+			checkpointFile = fmt.Sprintf("%s.slice%d", checkpointFile, i)
+		}
+
+		p, err := newPaginator(cfg.Pagination, cfg.Client, cfg.Index, rawQuery, query, cfg.Sort, checkpointFile)
+		if err != nil {
+			return err
+		}
+
+		paginators[i] = p
+	}
+
+	defer func() {
+		for _, p := range paginators {
+			if err := p.Close(); err != nil {
+				log.Printf("failed to close paginator: %v", err)
+			}
+		}
+	}()
+
+	pages := make(chan slicePage, DefaultPageBuffer)
+	sem := make(chan struct{}, cfg.Workers)
+
+	var producers sync.WaitGroup
+
+	for i, p := range paginators {
+		producers.Add(1)
+
+		go func(sliceID int, p Paginator) {
+			defer producers.Done()
+
+			for {
+				sem <- struct{}{}
+				result, err := p.Next()
+				<-sem
+
+				pages <- slicePage{sliceID: sliceID, result: result, err: err}
+
+				if err != nil {
+					return
+				}
+
+				if len(result.Hits.Hits) == int(result.Hits.Total.Value) {
+					return
+				}
+			}
+		}(i, p)
+	}
+
+	go func() {
+		producers.Wait()
+		close(pages)
+	}()
+
+	var hitCount int64
+	var totalCount int64
+	seenTotal := make([]bool, cfg.Slices)
+
+	var writeErr error
+
+	for page := range pages {
+		if page.err != nil && page.err != ErrNoMorePages {
+			writeErr = page.err
+			break
+		}
+
+		if !seenTotal[page.sliceID] {
+			seenTotal[page.sliceID] = true
+			atomic.AddInt64(&totalCount, int64(page.result.Hits.Total.Value))
+		}
+
+		for _, h := range page.result.Hits.Hits {
+			if err := cfg.Encoder.WriteRow(cfg.Header, h); err != nil {
+				writeErr = err
+				break
+			}
+		}
+
+		if writeErr != nil {
+			break
+		}
+
+		atomic.AddInt64(&hitCount, int64(len(page.result.Hits.Hits)))
+
+		log.Printf("got %d of %d", atomic.LoadInt64(&hitCount), atomic.LoadInt64(&totalCount))
+	}
+
+	// Drain any remaining pages so producer goroutines don't block forever sending to pages
+	// after a write error breaks us out of the loop above.
+	go func() {
+		for range pages {
+		}
+	}()
+
+	return writeErr
+}
+
+// withSlice merges an Elasticsearch `slice` clause into rawQuery (or builds one around query),
+// for slice id of max total slices. With max == 1 the query is returned unchanged, since a
+// single slice behaves identically to an unsliced query.
+func withSlice(rawQuery, query string, id, max int) (string, string, error) {
+	if max <= 1 {
+		return rawQuery, query, nil
+	}
+
+	body := map[string]interface{}{}
+
+	if rawQuery != "" {
+		if err := json.Unmarshal([]byte(rawQuery), &body); err != nil {
+			return "", "", err
+		}
+	} else if query != "" {
+		body["query"] = map[string]interface{}{
+			"query_string": map[string]string{
+				"query": query,
+			},
+		}
+	}
+
+	// Once sliced, the query always travels as rawQuery, so buildFirstPageBody's "size: 10000"
+	// default for a bare -query never fires. Set it here instead, unless the raw query already
+	// specified its own size, so -slices doesn't silently drop to Elasticsearch's default page
+	// size of 10.
+	if _, ok := body["size"]; !ok {
+		body["size"] = 10000
+	}
+
+	body["slice"] = map[string]int{
+		"id":  id,
+		"max": max,
+	}
+
+	data, err := json.Marshal(body)
+	if err != nil {
+		return "", "", err
+	}
+
+	return string(data), "", nil
+}
@@ -0,0 +1,54 @@
+package main
+
+import (
+	"encoding/json"
+	"testing"
+)
+
+func TestWithSliceNoop(t *testing.T) {
+	rawQuery, query, err := withSlice("", "some query", 0, 1)
+	if err != nil {
+		t.Fatalf("withSlice returned error: %v", err)
+	}
+
+	if rawQuery != "" || query != "some query" {
+		t.Errorf("withSlice(max=1) = (%q, %q), want unchanged", rawQuery, query)
+	}
+}
+
+func TestWithSliceDefaultsSize(t *testing.T) {
+	rawQuery, _, err := withSlice("", "some query", 0, 4)
+	if err != nil {
+		t.Fatalf("withSlice returned error: %v", err)
+	}
+
+	var body map[string]interface{}
+	if err := json.Unmarshal([]byte(rawQuery), &body); err != nil {
+		t.Fatalf("withSlice produced invalid JSON: %v", err)
+	}
+
+	if body["size"] != float64(10000) {
+		t.Errorf("withSlice size = %v, want 10000", body["size"])
+	}
+
+	slice, ok := body["slice"].(map[string]interface{})
+	if !ok || slice["id"] != float64(0) || slice["max"] != float64(4) {
+		t.Errorf("withSlice slice clause = %v, want {id:0, max:4}", body["slice"])
+	}
+}
+
+func TestWithSlicePreservesExplicitSize(t *testing.T) {
+	rawQuery, _, err := withSlice(`{"size": 500}`, "", 1, 4)
+	if err != nil {
+		t.Fatalf("withSlice returned error: %v", err)
+	}
+
+	var body map[string]interface{}
+	if err := json.Unmarshal([]byte(rawQuery), &body); err != nil {
+		t.Fatalf("withSlice produced invalid JSON: %v", err)
+	}
+
+	if body["size"] != float64(500) {
+		t.Errorf("withSlice size = %v, want 500", body["size"])
+	}
+}